@@ -0,0 +1,340 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+var _ = fmt.Print
+
+// OpKind identifies the kind of remote-side operation a FileOp node
+// performs, analogous to buildkit's pb.FileAction oneof.
+type OpKind string
+
+const (
+	OpSource  OpKind = "source" // a local source feeding the DAG, see SourceLocal
+	OpCopy    OpKind = "copy"
+	OpMkdir   OpKind = "mkdir"
+	OpRm      OpKind = "rm"
+	OpSymlink OpKind = "symlink"
+	OpChmod   OpKind = "chmod"
+	OpChown   OpKind = "chown"
+)
+
+// FileOp is one node in the DAG of remote-side operations describing a
+// single `kitten transfer` invocation. Each op except a source node reads
+// its inputs from the outputs of the ops listed in Inputs, so a whole tree
+// of copies/renames/permission changes can be sent and executed in one
+// round-trip instead of one shell command per step. Execution is not
+// atomic: ops that completed before a failing op are not undone.
+type FileOp struct {
+	ID     string   `json:"id"`
+	Kind   OpKind   `json:"kind"`
+	Inputs []string `json:"inputs,omitempty"` // ids of FileOp nodes this one depends on
+
+	// SourceLocal is set when Kind == OpSource: the local paths exactly as
+	// given. They are not scanned by process() or files_for_send().
+	SourceLocal []string `json:"source_local,omitempty"`
+
+	Src       string      `json:"src,omitempty"`
+	Dst       string      `json:"dst,omitempty"`
+	Mode      fs.FileMode `json:"mode,omitempty"`
+	Parents   bool        `json:"parents,omitempty"`
+	Recursive bool        `json:"recursive,omitempty"`
+	Target    string      `json:"target,omitempty"`
+	Link      string      `json:"link,omitempty"`
+	UID       int         `json:"uid,omitempty"`
+	GID       int         `json:"gid,omitempty"`
+}
+
+// cache_key returns a short hash of everything that determines this op's
+// output, so that repeated transfers of an unchanged subgraph can
+// short-circuit (checksum-wildcard style): if an op and every op it
+// transitively depends on hash the same as last time, it does not need to
+// be re-executed.
+func (self *FileOp) cache_key(dag *FileOpGraph) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s:%s:%s:%s:%o:%v:%v:%s:%s:%d:%d", self.Kind, self.Src, self.Dst,
+		"", self.Mode, self.Parents, self.Recursive, self.Target, self.Link, self.UID, self.GID)
+	for _, name := range self.SourceLocal {
+		fmt.Fprintf(h, ":src=%s", name)
+		if st, err := os.Lstat(name); err == nil {
+			fmt.Fprintf(h, "@%d:%d", st.Size(), st.ModTime().UnixNano())
+		}
+	}
+	for _, input_id := range self.Inputs {
+		if dep, ok := dag.nodes[input_id]; ok {
+			fmt.Fprintf(h, ":dep=%s", dep.cache_key(dag))
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// FileOpGraph is a DAG of FileOp nodes, serialized as JSON and sent to the
+// receiver in one protected round-trip. Results are reported back keyed by
+// the client-assigned op id.
+type FileOpGraph struct {
+	Ops   []*FileOp `json:"ops"`
+	nodes map[string]*FileOp
+}
+
+func NewFileOpGraph() *FileOpGraph {
+	return &FileOpGraph{nodes: make(map[string]*FileOp)}
+}
+
+func (self *FileOpGraph) add(op *FileOp) *FileOp {
+	self.Ops = append(self.Ops, op)
+	self.nodes[op.ID] = op
+	return op
+}
+
+// AddLocalSource adds a source node holding the given local paths, one input
+// node that downstream Copy/Mkdir/etc ops can depend on. The paths do not go
+// through the files_for_send scan: a Copy op copies each one's contents as
+// a single regular file, and a directory path is not walked.
+func (self *FileOpGraph) AddLocalSource(id string, paths []string) *FileOp {
+	return self.add(&FileOp{ID: id, Kind: OpSource, SourceLocal: paths})
+}
+
+func (self *FileOpGraph) AddCopy(id string, input, dst string) *FileOp {
+	return self.add(&FileOp{ID: id, Kind: OpCopy, Inputs: []string{input}, Dst: dst})
+}
+
+func (self *FileOpGraph) AddMkdir(id, path string, mode fs.FileMode, parents bool, inputs ...string) *FileOp {
+	return self.add(&FileOp{ID: id, Kind: OpMkdir, Inputs: inputs, Dst: path, Mode: mode, Parents: parents})
+}
+
+func (self *FileOpGraph) AddRm(id, path string, recursive bool, inputs ...string) *FileOp {
+	return self.add(&FileOp{ID: id, Kind: OpRm, Inputs: inputs, Dst: path, Recursive: recursive})
+}
+
+func (self *FileOpGraph) AddSymlink(id, target, link string, inputs ...string) *FileOp {
+	return self.add(&FileOp{ID: id, Kind: OpSymlink, Inputs: inputs, Target: target, Link: link})
+}
+
+func (self *FileOpGraph) AddChmod(id, path string, mode fs.FileMode, inputs ...string) *FileOp {
+	return self.add(&FileOp{ID: id, Kind: OpChmod, Inputs: inputs, Dst: path, Mode: mode})
+}
+
+func (self *FileOpGraph) AddChown(id, path string, uid, gid int, inputs ...string) *FileOp {
+	return self.add(&FileOp{ID: id, Kind: OpChown, Inputs: inputs, Dst: path, UID: uid, GID: gid})
+}
+
+// topologically_sorted returns the ops in dependency order, erroring out on
+// a cycle or on an input id that names no node (the builder methods above
+// do not check the input ids they are given).
+func (self *FileOpGraph) topologically_sorted() (ans []*FileOp, err error) {
+	visited := make(map[string]int) // 0 unvisited, 1 in-progress, 2 done
+	var visit func(op *FileOp) error
+	visit = func(op *FileOp) error {
+		switch visited[op.ID] {
+		case 2:
+			return nil
+		case 1:
+			return fmt.Errorf("cycle detected in FileOp graph at node %s", op.ID)
+		}
+		visited[op.ID] = 1
+		for _, input_id := range op.Inputs {
+			dep, ok := self.nodes[input_id]
+			if !ok {
+				return fmt.Errorf("FileOp %s depends on unknown node %s", op.ID, input_id)
+			}
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		visited[op.ID] = 2
+		ans = append(ans, op)
+		return nil
+	}
+	for _, op := range self.Ops {
+		if err = visit(op); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// OpResult is reported back to the sender once an op finishes executing on
+// the receiver, keyed by the client-assigned op id.
+type OpResult struct {
+	ID       string `json:"id"`
+	Err      string `json:"err,omitempty"`
+	Skipped  bool   `json:"skipped,omitempty"` // cache key matched, op was a no-op
+	CacheKey string `json:"cache_key"`
+}
+
+// FileOpExecutor runs a FileOpGraph on the receiving end, executing nodes
+// in dependency order and skipping any whose cache key matches the
+// corresponding entry in PreviousCacheKeys. handle_fileop creates its
+// executor with an empty PreviousCacheKeys, so graphs received over the
+// control channel never have an op skipped.
+type FileOpExecutor struct {
+	Root              string // the remote root all relative Dst/Link/Target paths are resolved against
+	PreviousCacheKeys map[string]string
+}
+
+func NewFileOpExecutor(root string) *FileOpExecutor {
+	return &FileOpExecutor{Root: root, PreviousCacheKeys: make(map[string]string)}
+}
+
+func (self *FileOpExecutor) resolve(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(self.Root, path)
+}
+
+// Execute runs every op in dag in dependency order, returning one
+// OpResult per op. Execution stops at the first op that errors out but
+// results for every op attempted so far (including that one) are
+// returned, so the sender can report precisely which steps of the DAG
+// succeeded.
+func (self *FileOpExecutor) Execute(dag *FileOpGraph) (results []OpResult, err error) {
+	ordered, err := dag.topologically_sorted()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range ordered {
+		key := op.cache_key(dag)
+		r := OpResult{ID: op.ID, CacheKey: key}
+		if self.PreviousCacheKeys[op.ID] == key {
+			r.Skipped = true
+			results = append(results, r)
+			continue
+		}
+		if exec_err := self.execute_one(dag, op); exec_err != nil {
+			r.Err = exec_err.Error()
+			results = append(results, r)
+			return results, fmt.Errorf("FileOp %s failed: %w", op.ID, exec_err)
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+func (self *FileOpExecutor) execute_one(dag *FileOpGraph, op *FileOp) error {
+	switch op.Kind {
+	case OpSource:
+		return nil // nothing to do, inputs are realised by the ops that consume them
+	case OpCopy:
+		return self.do_copy(dag, op)
+	case OpMkdir:
+		dst := self.resolve(op.Dst)
+		if op.Parents {
+			return os.MkdirAll(dst, op.Mode)
+		}
+		return os.Mkdir(dst, op.Mode)
+	case OpRm:
+		dst := self.resolve(op.Dst)
+		if op.Recursive {
+			return os.RemoveAll(dst)
+		}
+		return os.Remove(dst)
+	case OpSymlink:
+		return os.Symlink(op.Target, self.resolve(op.Link))
+	case OpChmod:
+		return os.Chmod(self.resolve(op.Dst), op.Mode)
+	case OpChown:
+		return os.Chown(self.resolve(op.Dst), op.UID, op.GID)
+	default:
+		return fmt.Errorf("unknown FileOp kind: %s", op.Kind)
+	}
+}
+
+// do_copy copies the paths named by op's source input node into op.Dst. A
+// Copy op normally depends on exactly one OpSource node (see
+// AddLocalSource); when that source lists a single path, Dst is the exact
+// destination file path (an existing directory at Dst makes the copy fail);
+// when it lists more than one path, each is copied into Dst, which must
+// already exist as a directory
+// by the time the Copy node runs (create it with a Mkdir node earlier in
+// the DAG if needed). A bare op.Src (set directly rather than via an
+// OpSource input) is honored as a single extra file to copy, for callers
+// that build FileOp nodes by hand instead of through AddLocalSource.
+func (self *FileOpExecutor) do_copy(dag *FileOpGraph, op *FileOp) error {
+	dst := self.resolve(op.Dst)
+	sources, err := self.copy_sources(dag, op)
+	if err != nil {
+		return err
+	}
+	if len(sources) == 0 {
+		return fmt.Errorf("FileOp %s is a copy with no source: neither an OpSource input nor Src is set", op.ID)
+	}
+	if len(sources) == 1 {
+		return copy_file(sources[0], dst)
+	}
+	for _, src := range sources {
+		if err := copy_file(src, filepath.Join(dst, filepath.Base(src))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copy_sources resolves the local paths op should copy from: whichever of
+// op.Src and the SourceLocal of op's OpSource input (if any) are present.
+func (self *FileOpExecutor) copy_sources(dag *FileOpGraph, op *FileOp) (sources []string, err error) {
+	for _, input_id := range op.Inputs {
+		dep, ok := dag.nodes[input_id]
+		if !ok {
+			return nil, fmt.Errorf("FileOp %s depends on unknown node %s", op.ID, input_id)
+		}
+		if dep.Kind == OpSource {
+			sources = append(sources, dep.SourceLocal...)
+		}
+	}
+	if op.Src != "" {
+		sources = append(sources, op.Src)
+	}
+	return sources, nil
+}
+
+func copy_file(src, dst string) error {
+	s, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	info, err := s.Stat()
+	if err != nil {
+		return err
+	}
+	d, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	_, err = io.Copy(d, s)
+	return err
+}
+
+// MarshalJSON is implemented explicitly only to keep the exported field
+// order stable across versions, matching how other kitty wire-format
+// structs in this codebase are defined.
+func (self *FileOpGraph) MarshalJSON() ([]byte, error) {
+	type alias FileOpGraph
+	return json.Marshal((*alias)(self))
+}
+
+// UnmarshalJSON rebuilds the id->node index after decoding Ops, since that
+// index is unexported (it is derived data, not part of the wire format).
+func (self *FileOpGraph) UnmarshalJSON(data []byte) error {
+	type alias FileOpGraph
+	if err := json.Unmarshal(data, (*alias)(self)); err != nil {
+		return err
+	}
+	self.nodes = make(map[string]*FileOp, len(self.Ops))
+	for _, op := range self.Ops {
+		self.nodes[op.ID] = op
+	}
+	return nil
+}
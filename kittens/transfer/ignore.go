@@ -0,0 +1,237 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var _ = fmt.Print
+
+const kittyignore_filename = ".kittyignore"
+const gitignore_filename = ".gitignore"
+
+// ignore_pattern is a single compiled line from a .kittyignore/.gitignore
+// file or an --exclude flag.
+type ignore_pattern struct {
+	negate   bool
+	dir_only bool
+	anchored bool
+	raw      string
+	re       *regexp.Regexp
+}
+
+// parse_ignore_pattern compiles a single pattern line using .gitignore
+// syntax: a leading ! negates the pattern, a trailing / restricts it to
+// matching directories only, a leading / anchors it to the directory the
+// pattern file lives in (otherwise it matches at any depth below it), and
+// *, **, ? and [...] are glob wildcards with ** matching across path
+// separators. Blank lines and lines starting with # are not patterns.
+func parse_ignore_pattern(line string) *ignore_pattern {
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+	p := &ignore_pattern{raw: line}
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	}
+	if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dir_only = true
+		line = strings.TrimSuffix(line, "/")
+	}
+	if strings.HasPrefix(line, "/") {
+		p.anchored = true
+		line = line[1:]
+	}
+	if strings.Contains(line, "/") {
+		// a pattern containing a slash (other than a trailing one already
+		// stripped above) is always anchored to the directory it came from
+		p.anchored = true
+	}
+	p.re = glob_to_regexp(line, p.anchored)
+	return p
+}
+
+// glob_to_regexp converts a single gitignore-style glob into an anchored
+// regexp. When anchored is false the pattern may match starting at any path
+// segment boundary.
+func glob_to_regexp(glob string, anchored bool) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	if !anchored {
+		b.WriteString("(?:.*/)?")
+	}
+	runes := []rune(glob)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch c {
+		case '*':
+			if i+1 < len(runes) && runes[i+1] == '*' {
+				// ** matches zero or more path segments
+				j := i + 2
+				if j < len(runes) && runes[j] == '/' {
+					j++
+					b.WriteString("(?:.*/)?")
+				} else {
+					// a trailing (or mid-segment) ** also matches the final segment
+					b.WriteString(".*")
+				}
+				i = j - 1
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '.', '+', '(', ')', '|', '^', '$', '{', '}':
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		case '[':
+			j := i + 1
+			for j < len(runes) && runes[j] != ']' {
+				j++
+			}
+			if j < len(runes) {
+				b.WriteString(string(runes[i : j+1]))
+				i = j
+			} else {
+				b.WriteString(regexp.QuoteMeta(string(c)))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+func (self *ignore_pattern) matches(rel_path string, is_dir bool) bool {
+	if self.dir_only && !is_dir {
+		return false
+	}
+	return self.re.MatchString(rel_path)
+}
+
+// ignore_level is the patterns read from a single directory's
+// .kittyignore/.gitignore (or, at the root, --exclude/--exclude-from),
+// together with base: the path of that directory relative to the root of
+// the transfer ("" at the top level). Patterns are matched against paths
+// relative to base, exactly as git matches a nested .gitignore's patterns
+// relative to the directory it lives in, not the repository root.
+type ignore_level struct {
+	base     string
+	patterns []*ignore_pattern
+}
+
+// ignore_matcher is a stack of ignore_levels: one entry per directory level
+// from the root of the transfer down to the directory currently being
+// scanned. Patterns from parent directories apply to everything below them;
+// patterns in a child directory's own .kittyignore are evaluated after (and
+// so can override, via negation) the inherited ones.
+type ignore_matcher struct {
+	levels []ignore_level
+}
+
+func new_ignore_matcher(root_patterns []*ignore_pattern) *ignore_matcher {
+	return &ignore_matcher{levels: []ignore_level{{base: "", patterns: root_patterns}}}
+}
+
+// descend returns a new matcher for the subdirectory at rel (its path
+// relative to the root of the transfer), with dir_patterns (read from that
+// subdirectory's own .kittyignore, if any) appended on top of the inherited
+// stack.
+func (self *ignore_matcher) descend(rel string, dir_patterns []*ignore_pattern) *ignore_matcher {
+	levels := make([]ignore_level, len(self.levels), len(self.levels)+1)
+	copy(levels, self.levels)
+	if len(dir_patterns) > 0 {
+		levels = append(levels, ignore_level{base: rel, patterns: dir_patterns})
+	}
+	return &ignore_matcher{levels: levels}
+}
+
+// is_ignored evaluates every inherited and local pattern against rel_path
+// (relative to the root of the transfer, always using / separators), in
+// order, so that a later negation can un-exclude something an earlier
+// pattern excluded. Each level's patterns are matched against rel_path made
+// relative to that level's own base, so a non-anchored pattern from a
+// subdirectory's ignore file only matches within that subdirectory, and an
+// anchored (leading /) pattern anchors to the subdirectory rather than the
+// transfer root.
+func (self *ignore_matcher) is_ignored(rel_path string, is_dir bool) bool {
+	ignored := false
+	for _, level := range self.levels {
+		sub_path := rel_path
+		if level.base != "" {
+			prefix := level.base + "/"
+			if !strings.HasPrefix(rel_path+"/", prefix) {
+				continue
+			}
+			sub_path = strings.TrimPrefix(rel_path, prefix)
+		}
+		for _, p := range level.patterns {
+			if p.matches(sub_path, is_dir) {
+				ignored = !p.negate
+			}
+		}
+	}
+	return ignored
+}
+
+func read_ignore_file(path string) (patterns []*ignore_pattern, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if p := parse_ignore_pattern(line); p != nil {
+			patterns = append(patterns, p)
+		}
+	}
+	return
+}
+
+// read_dir_ignore_patterns reads both .kittyignore and .gitignore from dir
+// (either may be absent), .kittyignore patterns taking precedence by being
+// evaluated after the .gitignore ones.
+func read_dir_ignore_patterns(dir string) (patterns []*ignore_pattern, err error) {
+	gi, err := read_ignore_file(filepath.Join(dir, gitignore_filename))
+	if err != nil {
+		return nil, err
+	}
+	ki, err := read_ignore_file(filepath.Join(dir, kittyignore_filename))
+	if err != nil {
+		return nil, err
+	}
+	patterns = append(patterns, gi...)
+	patterns = append(patterns, ki...)
+	return
+}
+
+// root_ignore_patterns builds the initial pattern list from
+// Options.Exclude and Options.ExcludeFrom, used as the base of the matcher
+// stack before any per-directory .kittyignore files are read.
+func root_ignore_patterns(opts *Options) (patterns []*ignore_pattern, err error) {
+	for _, pat := range opts.Exclude {
+		if p := parse_ignore_pattern(pat); p != nil {
+			patterns = append(patterns, p)
+		}
+	}
+	if opts.ExcludeFrom != "" {
+		from_file, err := read_ignore_file(opts.ExcludeFrom)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read --exclude-from file %s with error: %w", opts.ExcludeFrom, err)
+		}
+		patterns = append(patterns, from_file...)
+	}
+	return
+}
@@ -0,0 +1,30 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+// Options holds the parsed command line options for `kitten transfer`.
+type Options struct {
+	Mode string
+
+	// Protocol selects the remote transport. The empty string (the
+	// default) means kitty's own graphics-protocol-adjacent file transfer
+	// escape codes, which only work when both ends are running kitty.
+	// "sftp" instead opens an SSH connection and speaks SFTP, for use with
+	// any remote that has an sftp-server, not just other kitty instances.
+	Protocol string
+
+	// Receive is set on the copy of this binary kitty execs on the far end
+	// of the connection (analogous to rsync's --server flag): instead of
+	// scanning local paths to send, it reads the escape-code control
+	// channel on stdin and reconstructs files under the path in args[0].
+	Receive bool
+
+	// Exclude is the set of glob patterns passed via repeated --exclude
+	// flags, applied in addition to any .kittyignore files found while
+	// walking the source directories.
+	Exclude []string
+
+	// ExcludeFrom is the path to a file of newline separated patterns in
+	// .gitignore syntax, equivalent to passing each line as --exclude.
+	ExcludeFrom string
+}
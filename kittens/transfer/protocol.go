@@ -0,0 +1,135 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+var _ = fmt.Print
+
+// file_transfer_osc is the OSC code kitty reserves for the file transfer
+// protocol's control channel; commands are JSON encoded, base64 wrapped and
+// terminated with BEL, the same framing used by kitty's other OSC based
+// protocols.
+const file_transfer_osc = "5113"
+
+// wire_signature is the over-the-wire form of block_signature: the strong
+// hash travels as hex rather than as a fixed size byte array so it survives
+// a JSON round trip.
+type wire_signature struct {
+	Index  int64  `json:"index"`
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+func (self block_signature) to_wire() wire_signature {
+	return wire_signature{Index: self.index, Weak: self.weak, Strong: hex.EncodeToString(self.strong[:])}
+}
+
+func (self wire_signature) to_signature() (ans block_signature, err error) {
+	ans.index, ans.weak = self.Index, self.Weak
+	raw, err := hex.DecodeString(self.Strong)
+	if err != nil {
+		return ans, err
+	}
+	copy(ans.strong[:], raw)
+	return ans, nil
+}
+
+// wire_command is a single message exchanged between the sender and
+// receiver ends of `kitten transfer` over the terminal's escape code
+// channel. Only the fields relevant to Action are populated.
+type wire_command struct {
+	Action string `json:"action"` // file, sig_request, sig_response, data, end_data, fileop, fileop_result
+
+	FileID    string `json:"file_id,omitempty"`
+	Path      string `json:"path,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+	Mode      uint32 `json:"mode,omitempty"`
+	MtimeUnix int64  `json:"mtime,omitempty"`
+
+	// FileType/LinkTarget only accompany the "file" action: FileType is a
+	// FileType (DIRECTORY_FILE/SYMLINK_FILE/LINK_FILE get created directly
+	// on receipt, with no data stream to follow); for a SYMLINK_FILE,
+	// LinkTarget is the raw link target, for a LINK_FILE it is the file_id
+	// of the file it is hard-linked to (see begin_file).
+	FileType   int    `json:"file_type,omitempty"`
+	LinkTarget string `json:"link_target,omitempty"`
+
+	BlockSize  int64            `json:"block_size,omitempty"`
+	Signatures []wire_signature `json:"signatures,omitempty"`
+
+	IsLiteral  bool   `json:"is_literal,omitempty"`
+	Literal    []byte `json:"literal,omitempty"`
+	BlockIndex int64  `json:"block_index,omitempty"`
+
+	// Graph/Results carry a FileOpGraph and its execution results for the
+	// "fileop"/"fileop_result" actions (see SendFileOps/receive_main).
+	Graph   *FileOpGraph `json:"graph,omitempty"`
+	Results []OpResult   `json:"results,omitempty"`
+
+	Err string `json:"err,omitempty"`
+}
+
+// write_command serializes cmd and writes it to w framed as an OSC escape
+// code: \x1b]5113;<base64 json>\x07
+func write_command(w io.Writer, cmd wire_command) error {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString(data)
+	_, err = fmt.Fprintf(w, "\x1b]%s;%s\x07", file_transfer_osc, encoded)
+	return err
+}
+
+// read_command reads and decodes the next OSC-framed wire_command from r,
+// skipping over any bytes that are not part of a file-transfer OSC
+// sequence (the terminal may interleave other output on the same stream).
+func read_command(r *bufio.Reader) (cmd wire_command, err error) {
+	prefix := "\x1b]" + file_transfer_osc + ";"
+	for {
+		if _, err = r.ReadString(prefix[0]); err != nil {
+			return cmd, err
+		}
+		matched := true
+		for i := 1; i < len(prefix); i++ {
+			b, rerr := r.ReadByte()
+			if rerr != nil {
+				return cmd, rerr
+			}
+			if b != prefix[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			break
+		}
+	}
+	payload, err := r.ReadString('\a')
+	if err != nil {
+		return cmd, err
+	}
+	payload = payload[:len(payload)-1]
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return cmd, err
+	}
+	err = json.Unmarshal(data, &cmd)
+	return cmd, err
+}
+
+// send_op writes a single rsync_op for file_id as a "data" wire_command,
+// used as the send_op callback passed to File.rsync_transmit.
+func send_op(w io.Writer, file_id string, op rsync_op) error {
+	return write_command(w, wire_command{
+		Action: "data", FileID: file_id, IsLiteral: op.is_literal, Literal: op.literal, BlockIndex: op.block_index,
+	})
+}
@@ -0,0 +1,279 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var _ = fmt.Print
+
+// receiving_file tracks the state needed to reconstruct one file on the
+// receiving end of the escape-code control channel driven by send_main /
+// transmit_files.
+type receiving_file struct {
+	path      string
+	mode      os.FileMode
+	mtime     time.Time
+	old_copy  *os.File // the existing file at path, opened read-only, used as the rsync delta source
+	dest      *os.File // a temporary file the incoming data is written to before being renamed into place
+	dest_path string
+}
+
+// receive_main runs the receiving end of `kitten transfer`: it reads
+// wire_commands from r and, for files the sender marks rsync_capable,
+// answers sig_request with the signature of whatever already exists at the
+// destination path (computed with calculate_signature), then applies the
+// stream of literal/copy data ops that follows to reconstruct the file
+// under root.
+func receive_main(root string, r *bufio.Reader, w io.Writer) error {
+	files := make(map[string]*receiving_file)
+	// paths records the final on-disk path of every file_id seen so far, so
+	// that a later LINK_FILE/SYMLINK_FILE can resolve a "fid:"/"fid_abs:"
+	// target or a hard link's file_id into an actual path: for directories
+	// and symlinks that happens as soon as begin_file creates them, for
+	// regular files only once finish_file has renamed the temp file into
+	// place (files_for_send always orders a hard link's target before it).
+	paths := make(map[string]string)
+	defer func() {
+		for _, rf := range files {
+			if rf.old_copy != nil {
+				rf.old_copy.Close()
+			}
+			if rf.dest != nil {
+				rf.dest.Close()
+			}
+		}
+	}()
+	for {
+		cmd, err := read_command(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch cmd.Action {
+		case "file":
+			if err := begin_file(root, cmd, files, paths); err != nil {
+				return err
+			}
+		case "sig_request":
+			if err := handle_sig_request(w, cmd, files); err != nil {
+				return err
+			}
+		case "data":
+			if err := apply_data_op(cmd, files); err != nil {
+				return err
+			}
+		case "end_data":
+			if err := finish_file(cmd, files, paths); err != nil {
+				return err
+			}
+		case "fileop":
+			if err := handle_fileop(root, w, cmd); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// begin_file handles a "file" announcement. DIRECTORY_FILE/SYMLINK_FILE/
+// LINK_FILE carry everything needed to create them directly and are done
+// immediately, with no data stream or end_data to follow; REGULAR_FILE opens
+// a temp file that apply_data_op/finish_file later write to and rename into
+// place.
+func begin_file(root string, cmd wire_command, files map[string]*receiving_file, paths map[string]string) error {
+	path := filepath.Join(root, filepath.FromSlash(cmd.Path))
+	switch FileType(cmd.FileType) {
+	case DIRECTORY_FILE:
+		if err := os.MkdirAll(path, os.FileMode(cmd.Mode)); err != nil {
+			return err
+		}
+		paths[cmd.FileID] = path
+		return nil
+	case SYMLINK_FILE:
+		target, err := resolve_local_symlink_target(cmd.LinkTarget, path, paths)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Symlink(target, path); err != nil {
+			return err
+		}
+		paths[cmd.FileID] = path
+		return nil
+	case LINK_FILE:
+		target, ok := paths[cmd.LinkTarget]
+		if !ok {
+			return fmt.Errorf("hard link %s refers to unknown file id %s", path, cmd.LinkTarget)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Link(target, path); err != nil {
+			return err
+		}
+		paths[cmd.FileID] = path
+		return nil
+	}
+
+	rf := &receiving_file{path: path, mode: os.FileMode(cmd.Mode), mtime: time.Unix(cmd.MtimeUnix, 0)}
+	if old, err := os.Open(path); err == nil {
+		rf.old_copy = old
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	dest, err := os.CreateTemp(filepath.Dir(path), ".kitty-transfer-*")
+	if err != nil {
+		return err
+	}
+	rf.dest, rf.dest_path = dest, dest.Name()
+	files[cmd.FileID] = rf
+	return nil
+}
+
+// resolve_local_symlink_target turns the raw LinkTarget carried by a "file"
+// wire_command for a SYMLINK_FILE into the target to actually pass to
+// os.Symlink, mirroring sftpSender.resolve_symlink_target: a target that
+// points at another file in the same transfer is encoded by send.go's
+// symlink-rewriting as "fid:"/"fid_abs:" + file_id and must be resolved
+// against paths (the "fid" form relative to own_path's directory, to
+// reproduce the original relative link); anything else is a plain
+// filesystem path used verbatim.
+func resolve_local_symlink_target(raw string, own_path string, paths map[string]string) (string, error) {
+	switch {
+	case strings.HasPrefix(raw, "path:"):
+		return strings.TrimPrefix(raw, "path:"), nil
+	case strings.HasPrefix(raw, "fid_abs:"):
+		id := strings.TrimPrefix(raw, "fid_abs:")
+		target, ok := paths[id]
+		if !ok {
+			return "", fmt.Errorf("symlink %s refers to unknown file id %s", own_path, id)
+		}
+		return target, nil
+	case strings.HasPrefix(raw, "fid:"):
+		id := strings.TrimPrefix(raw, "fid:")
+		target, ok := paths[id]
+		if !ok {
+			return "", fmt.Errorf("symlink %s refers to unknown file id %s", own_path, id)
+		}
+		rel, err := filepath.Rel(filepath.Dir(own_path), target)
+		if err != nil {
+			return target, nil
+		}
+		return rel, nil
+	default:
+		return raw, nil
+	}
+}
+
+// handle_sig_request answers a sender's request for the signature of the
+// file the receiver already has at this path: calculate_signature() splits
+// it into rsync_block_size blocks and computes their weak/strong checksums,
+// which travel back as a sig_response so the sender can diff against them.
+// When there is no existing copy a sig_response with Size: -1 is sent and
+// the sender falls back to transmitting the whole file.
+func handle_sig_request(w io.Writer, cmd wire_command, files map[string]*receiving_file) error {
+	rf, ok := files[cmd.FileID]
+	if !ok || rf.old_copy == nil {
+		return write_command(w, wire_command{Action: "sig_response", FileID: cmd.FileID, Size: -1})
+	}
+	info, err := rf.old_copy.Stat()
+	if err != nil {
+		return write_command(w, wire_command{Action: "sig_response", FileID: cmd.FileID, Size: -1})
+	}
+	signatures, err := calculate_signature(rf.old_copy)
+	if err != nil {
+		return err
+	}
+	wire_sigs := make([]wire_signature, len(signatures))
+	for i, s := range signatures {
+		wire_sigs[i] = s.to_wire()
+	}
+	return write_command(w, wire_command{
+		Action: "sig_response", FileID: cmd.FileID, Size: info.Size(), Signatures: wire_sigs,
+	})
+}
+
+// apply_data_op appends one rsync_op to the file being reconstructed: a
+// literal run is written as-is, a block copy reads the corresponding block
+// out of the receiver's existing copy of the file (the same one
+// calculate_signature() was run over).
+func apply_data_op(cmd wire_command, files map[string]*receiving_file) error {
+	rf, ok := files[cmd.FileID]
+	if !ok {
+		return fmt.Errorf("data command for unknown file id: %s", cmd.FileID)
+	}
+	if cmd.IsLiteral {
+		_, err := rf.dest.Write(cmd.Literal)
+		return err
+	}
+	if rf.old_copy == nil {
+		return fmt.Errorf("copy op for file id %s with no existing local copy", cmd.FileID)
+	}
+	block := make([]byte, rsync_block_size)
+	n, err := rf.old_copy.ReadAt(block, cmd.BlockIndex*rsync_block_size)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	_, err = rf.dest.Write(block[:n])
+	return err
+}
+
+// handle_fileop executes the FileOpGraph carried by cmd (see
+// FileOpGraph/FileOpExecutor) rooted at root, reporting one OpResult per
+// node attempted back to the sender via a "fileop_result" command.
+func handle_fileop(root string, w io.Writer, cmd wire_command) error {
+	if cmd.Graph == nil {
+		return write_command(w, wire_command{Action: "fileop_result", Err: "fileop command with no graph"})
+	}
+	executor := NewFileOpExecutor(root)
+	results, exec_err := executor.Execute(cmd.Graph)
+	resp := wire_command{Action: "fileop_result", Results: results}
+	if exec_err != nil {
+		resp.Err = exec_err.Error()
+	}
+	return write_command(w, resp)
+}
+
+func finish_file(cmd wire_command, files map[string]*receiving_file, paths map[string]string) error {
+	rf, ok := files[cmd.FileID]
+	if !ok {
+		return fmt.Errorf("end_data command for unknown file id: %s", cmd.FileID)
+	}
+	if rf.old_copy != nil {
+		rf.old_copy.Close()
+		rf.old_copy = nil
+	}
+	if err := rf.dest.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(rf.dest_path, rf.mode); err != nil {
+		return err
+	}
+	if err := os.Chtimes(rf.dest_path, rf.mtime, rf.mtime); err != nil {
+		return err
+	}
+	if err := os.Rename(rf.dest_path, rf.path); err != nil {
+		return err
+	}
+	delete(files, cmd.FileID)
+	paths[cmd.FileID] = rf.path
+	return nil
+}
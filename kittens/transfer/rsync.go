@@ -0,0 +1,221 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+var _ = fmt.Print
+
+// rsync_block_size is the size in bytes of the blocks the receiver splits
+// its existing copy of a file into when computing a signature. Larger
+// blocks mean a smaller signature but coarser delta matching.
+const rsync_block_size = 6000
+
+// a weak, O(1)-updatable rolling checksum modelled on the Adler-32 style
+// checksum used by rsync itself: sum_of_bytes (a) plus sum_of_sums (b)
+type rolling_checksum struct {
+	a, b uint32
+	n    uint32
+}
+
+func new_rolling_checksum(block []byte) *rolling_checksum {
+	self := &rolling_checksum{n: uint32(len(block))}
+	for i, b := range block {
+		self.a += uint32(b)
+		self.b += (self.n - uint32(i)) * uint32(b)
+	}
+	return self
+}
+
+func (self *rolling_checksum) Sum() uint32 {
+	return (self.b << 16) | (self.a & 0xffff)
+}
+
+// roll slides the window forward by one byte: out is the byte leaving the
+// window and in is the byte entering it.
+func (self *rolling_checksum) roll(out, in byte) {
+	self.a = self.a - uint32(out) + uint32(in)
+	self.b = self.b - self.n*uint32(out) + self.a
+}
+
+type block_signature struct {
+	index  int64
+	weak   uint32
+	strong [blake2b.Size256]byte
+}
+
+func strong_checksum(block []byte) (ans [blake2b.Size256]byte) {
+	ans = blake2b.Sum256(block)
+	return
+}
+
+// calculate_signature reads the receiver's existing copy of a file and
+// returns one block_signature per rsync_block_size sized chunk (the final
+// chunk may be shorter). This is run on the receiving side and the result
+// sent back to the sender before transmission starts.
+func calculate_signature(f io.Reader) (signatures []block_signature, err error) {
+	buf := make([]byte, rsync_block_size)
+	var index int64
+	for {
+		n, rerr := io.ReadFull(f, buf)
+		if n > 0 {
+			block := buf[:n]
+			signatures = append(signatures, block_signature{
+				index: index, weak: new_rolling_checksum(block).Sum(), strong: strong_checksum(block),
+			})
+			index++
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return nil, rerr
+		}
+	}
+	return
+}
+
+// rsync_op is a single instruction for reconstructing the new file from a
+// stream of these ops: either copy a block of the old (remote) file
+// unchanged, or literal bytes that do not match anything in the old file.
+type rsync_op struct {
+	is_literal  bool
+	literal     []byte
+	block_index int64
+}
+
+// rsyncTransmitter computes the delta between the local copy of a file and
+// the signature of the remote copy already on disk at the destination,
+// producing a minimal stream of rsync_op values for the TRANSMITTING state
+// of File to send instead of the entire file.
+type rsyncTransmitter struct {
+	signatures  []block_signature
+	by_weak     map[uint32][]int // index into signatures, keyed by weak checksum
+	block_size  int64
+	remote_size int64
+}
+
+func new_rsync_transmitter(signatures []block_signature, remote_size int64) *rsyncTransmitter {
+	self := &rsyncTransmitter{signatures: signatures, remote_size: remote_size, block_size: rsync_block_size}
+	self.by_weak = make(map[uint32][]int, len(signatures))
+	for i, s := range signatures {
+		self.by_weak[s.weak] = append(self.by_weak[s.weak], i)
+	}
+	return self
+}
+
+// find_match returns the index of a signature block whose weak and strong
+// checksums both match block, or -1 if there is no match.
+func (self *rsyncTransmitter) find_match(block []byte, weak uint32) int {
+	for _, i := range self.by_weak[weak] {
+		if strong_checksum(block) == self.signatures[i].strong {
+			return i
+		}
+	}
+	return -1
+}
+
+// delta computes the ops needed to reconstruct local_path on the receiver,
+// given that it already has a file matching self.signatures. It slides a
+// byte-by-byte window over the local file, maintaining the rolling weak
+// checksum with roll() (an O(1) update per step) rather than recomputing it
+// over the full block_size window from scratch, and emits a literal run
+// whenever no block matches, flushing it as soon as a match is found. The
+// rolling checksum is only recomputed from scratch when a match is found
+// (the next window starts bs bytes ahead, so it is not adjacent to the one
+// just matched) or at the very first window.
+func (self *rsyncTransmitter) delta(f *os.File) (ops []rsync_op, err error) {
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	bs := int(self.block_size)
+	n := len(data)
+	var literal []byte
+	flush_literal := func() {
+		if len(literal) > 0 {
+			ops = append(ops, rsync_op{is_literal: true, literal: literal})
+			literal = nil
+		}
+	}
+	i := 0
+	var rc *rolling_checksum
+	for i < n {
+		if n-i < bs {
+			// too little data left for a full block: it can never match
+			// (matches are only ever full block_size windows), so there is
+			// no point maintaining a checksum for it
+			literal = append(literal, data[i:]...)
+			break
+		}
+		if rc == nil {
+			rc = new_rolling_checksum(data[i : i+bs])
+		}
+		if idx := self.find_match(data[i:i+bs], rc.Sum()); idx >= 0 {
+			flush_literal()
+			ops = append(ops, rsync_op{block_index: self.signatures[idx].index})
+			i += bs
+			rc = nil
+			continue
+		}
+		literal = append(literal, data[i])
+		if i+bs < n {
+			rc.roll(data[i], data[i+bs])
+		}
+		i++
+	}
+	flush_literal()
+	return ops, nil
+}
+
+// make_transmitter builds the rsyncTransmitter for f, ignoring signatures
+// (so every byte becomes literal data) when the remote file does not exist.
+func make_transmitter(f *File, signatures []block_signature) *rsyncTransmitter {
+	if f.remote_initial_size == -1 {
+		return new_rsync_transmitter(nil, -1)
+	}
+	return new_rsync_transmitter(signatures, f.remote_initial_size)
+}
+
+// rsync_transmit is called from the TRANSMITTING state of File when
+// rsync_capable is set. signatures is nil when remote_initial_size == -1
+// (the remote file does not exist yet), in which case the whole file is
+// sent as a single literal op and no block matching is attempted.
+func (self *File) rsync_transmit(signatures []block_signature, send_op func(rsync_op) error) (err error) {
+	if self.actual_file == nil {
+		self.actual_file, err = os.Open(self.expanded_local_path)
+		if err != nil {
+			return err
+		}
+		defer self.actual_file.Close()
+	}
+	t := make_transmitter(self, signatures)
+	ops, err := t.delta(self.actual_file)
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if err = send_op(op); err != nil {
+			return err
+		}
+		if op.is_literal {
+			self.transmitted_bytes += int64(len(op.literal))
+		} else {
+			self.transmitted_bytes += t.block_size_for(op.block_index)
+		}
+	}
+	return nil
+}
+
+func (self *rsyncTransmitter) block_size_for(index int64) int64 {
+	if index == int64(len(self.signatures)-1) && self.remote_size%self.block_size != 0 {
+		return self.remote_size % self.block_size
+	}
+	return self.block_size
+}
@@ -3,7 +3,10 @@
 package transfer
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/fs"
 	"kitty/tools/utils"
 	"kitty/tools/wcswidth"
@@ -131,12 +134,32 @@ func NewFile(local_path, expanded_local_path string, file_id int, stat_result fs
 }
 
 func process(opts *Options, paths []string, remote_base string, counter *int) (ans []*File, err error) {
+	root_patterns, err := root_ignore_patterns(opts)
+	if err != nil {
+		return nil, err
+	}
+	return process_with_matcher(opts, paths, remote_base, counter, "", new_ignore_matcher(root_patterns))
+}
+
+// process_with_matcher is the recursive implementation of process(). rel
+// is the path of the current directory relative to the root of the
+// transfer (using / separators, "" at the top level) and is what
+// .kittyignore/.gitignore patterns are matched against; matcher carries the
+// patterns inherited from rel's ancestors plus rel's own .kittyignore.
+func process_with_matcher(opts *Options, paths []string, remote_base string, counter *int, rel string, matcher *ignore_matcher) (ans []*File, err error) {
 	for _, x := range paths {
 		expanded := expand_home(x)
 		s, err := os.Lstat(expanded)
 		if err != nil {
 			return ans, fmt.Errorf("Failed to stat %s with error: %w", x, err)
 		}
+		child_rel := filepath.Base(x)
+		if rel != "" {
+			child_rel = rel + "/" + child_rel
+		}
+		if matcher.is_ignored(child_rel, s.IsDir()) {
+			continue
+		}
 		if s.IsDir() {
 			*counter += 1
 			ans = append(ans, NewFile(x, expanded, *counter, s, remote_base, DIRECTORY_FILE))
@@ -146,6 +169,10 @@ func process(opts *Options, paths []string, remote_base string, counter *int) (a
 			} else {
 				new_remote_base = strings.TrimRight(filepath.ToSlash(x), "/") + "/"
 			}
+			dir_patterns, err := read_dir_ignore_patterns(expanded)
+			if err != nil {
+				return ans, fmt.Errorf("Failed to read ignore files in %s with error: %w", expanded, err)
+			}
 			contents, err := os.ReadDir(expanded)
 			if err != nil {
 				return ans, fmt.Errorf("Failed to read the directory %s with error: %w", x, err)
@@ -154,7 +181,7 @@ func process(opts *Options, paths []string, remote_base string, counter *int) (a
 			for i, y := range contents {
 				new_paths[i] = filepath.Join(x, y.Name())
 			}
-			new_ans, err := process(opts, new_paths, new_remote_base, counter)
+			new_ans, err := process_with_matcher(opts, new_paths, new_remote_base, counter, child_rel, matcher.descend(child_rel, dir_patterns))
 			if err != nil {
 				return ans, err
 			}
@@ -269,6 +296,74 @@ func files_for_send(opts *Options, args []string) (files []*File, err error) {
 	return files, nil
 }
 
+// Main is the entry point for `kitten transfer`. When opts.Receive is set
+// this process is the copy kitty execs on the far end of the connection
+// (analogous to rsync's --server mode) and just answers the control
+// channel on stdin/stdout; otherwise it is the side the user actually
+// invoked and does the scanning/sending.
+func Main(opts *Options, args []string) error {
+	if opts.Receive {
+		if len(args) < 1 {
+			return fmt.Errorf("Must specify the destination root directory")
+		}
+		return receive_main(args[0], bufio.NewReader(os.Stdin), os.Stdout)
+	}
+	if opts.Mode == "fileops" {
+		if len(args) < 1 {
+			return fmt.Errorf("Must specify a path to a JSON encoded FileOpGraph")
+		}
+		return run_fileops_main(args[0])
+	}
+	return send_main(opts, args)
+}
+
+// run_fileops_main sends the FileOpGraph encoded as JSON in graph_path to
+// the receiver and prints the result of each op, used by `kitten transfer
+// --mode=fileops graph.json` to drive a multi-step remote operation (copy
+// into place, chmod, symlink, etc) in one round-trip instead of one
+// invocation of `kitten transfer` per step.
+func run_fileops_main(graph_path string) error {
+	data, err := os.ReadFile(graph_path)
+	if err != nil {
+		return err
+	}
+	dag := &FileOpGraph{}
+	if err := json.Unmarshal(data, dag); err != nil {
+		return fmt.Errorf("Failed to parse %s as a FileOpGraph with error: %w", graph_path, err)
+	}
+	results, err := SendFileOps(os.Stdout, bufio.NewReader(os.Stdin), dag)
+	for _, r := range results {
+		status := "ok"
+		if r.Skipped {
+			status = "skipped (unchanged)"
+		} else if r.Err != "" {
+			status = "FAILED: " + r.Err
+		}
+		fmt.Printf("%s: %s\n", r.ID, status)
+	}
+	return err
+}
+
+// SendFileOps sends dag to the receiver over the control channel in w/r
+// and waits for it to report back one OpResult per node it attempted
+// (execution stops at the first failing node).
+func SendFileOps(w io.Writer, r *bufio.Reader, dag *FileOpGraph) ([]OpResult, error) {
+	if err := write_command(w, wire_command{Action: "fileop", Graph: dag}); err != nil {
+		return nil, err
+	}
+	resp, err := read_command(r)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Action != "fileop_result" {
+		return nil, fmt.Errorf("Received unexpected response action to a fileop command: %s", resp.Action)
+	}
+	if resp.Err != "" {
+		return resp.Results, fmt.Errorf("%s", resp.Err)
+	}
+	return resp.Results, nil
+}
+
 func send_main(opts *Options, args []string) (err error) {
 	fmt.Println("Scanning files…")
 	files, err := files_for_send(opts, args)
@@ -278,5 +373,107 @@ func send_main(opts *Options, args []string) (err error) {
 	fmt.Printf("Found %d files and directories, requesting transfer permission…", len(files))
 	fmt.Println()
 
-	return
+	if opts.Protocol == "sftp" {
+		return send_via_sftp(opts, remote_host(args), files, report_sftp_progress)
+	}
+
+	return transmit_files(os.Stdout, bufio.NewReader(os.Stdin), files)
+}
+
+// transmit_files drives every regular File through the TRANSMITTING state
+// over the escape-code control channel in w/r: it announces each file,
+// and for rsync_capable files requests the receiver's signature of its
+// existing copy before computing and sending only the delta, falling back
+// to sending the whole file as a single literal op for everything else.
+// Directories/symlinks/hard-links carry everything the receiver needs (see
+// FileType/LinkTarget on wire_command) in the "file" announcement itself,
+// are created directly by begin_file, and have no data stream or end_data
+// to follow.
+func transmit_files(w io.Writer, r *bufio.Reader, files []*File) error {
+	for _, f := range files {
+		f.state = WAITING_FOR_START
+		cmd := wire_command{
+			Action: "file", FileID: f.file_id, Path: f.remote_path, Size: f.file_size,
+			Mode: uint32(f.permissions), MtimeUnix: f.mtime.Unix(), FileType: int(f.file_type),
+		}
+		switch f.file_type {
+		case SYMLINK_FILE:
+			cmd.LinkTarget = f.symbolic_link_target
+		case LINK_FILE:
+			cmd.LinkTarget = f.hard_link_target
+		}
+		if err := write_command(w, cmd); err != nil {
+			return err
+		}
+		if f.file_type != REGULAR_FILE {
+			f.state = FINISHED
+			f.done_at = time.Now()
+			continue
+		}
+		f.state = TRANSMITTING
+		if err := transmit_one_file(w, r, f); err != nil {
+			return fmt.Errorf("Failed to transmit %s with error: %w", f.local_path, err)
+		}
+		f.state = FINISHED
+		f.done_at = time.Now()
+		if err := write_command(w, wire_command{Action: "end_data", FileID: f.file_id}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transmit_one_file sends f's contents, using the rsync delta protocol when
+// f.rsync_capable is set and the receiver confirms (via a sig_response) that
+// it already has a copy of the file worth diffing against; otherwise the
+// whole file is sent as a single literal op.
+func transmit_one_file(w io.Writer, r *bufio.Reader, f *File) error {
+	op_sender := func(op rsync_op) error { return send_op(w, f.file_id, op) }
+
+	if f.rsync_capable {
+		if err := write_command(w, wire_command{Action: "sig_request", FileID: f.file_id, BlockSize: rsync_block_size}); err != nil {
+			return err
+		}
+		resp, err := read_command(r)
+		if err == nil && resp.Action == "sig_response" && resp.FileID == f.file_id && resp.Size >= 0 {
+			signatures := make([]block_signature, 0, len(resp.Signatures))
+			for _, ws := range resp.Signatures {
+				sig, serr := ws.to_signature()
+				if serr != nil {
+					return serr
+				}
+				signatures = append(signatures, sig)
+			}
+			f.remote_initial_size = resp.Size
+			return f.rsync_transmit(signatures, op_sender)
+		}
+		// receiver does not have a usable copy of the file (or does not
+		// understand the rsync handshake): fall through to a full send
+		f.remote_initial_size = -1
+	}
+
+	data, err := os.ReadFile(f.expanded_local_path)
+	if err != nil {
+		return err
+	}
+	if err := op_sender(rsync_op{is_literal: true, literal: data}); err != nil {
+		return err
+	}
+	f.transmitted_bytes = int64(len(data))
+	return nil
+}
+
+// remote_host extracts the host portion of the last (scp-style host:path)
+// command line argument, used to know where to open the SSH connection for
+// the sftp protocol.
+func remote_host(args []string) string {
+	last := args[len(args)-1]
+	if idx := strings.IndexByte(last, ':'); idx >= 0 {
+		return last[:idx]
+	}
+	return last
+}
+
+func report_sftp_progress(f *File) {
+	f.reported_progress = f.transmitted_bytes
 }
@@ -0,0 +1,312 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package transfer
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var _ = fmt.Print
+
+// sftp_transfer_buffer_size is the chunk size used when streaming file
+// contents over SFTP; pkg/sftp pipelines reads/writes up to this size.
+const sftp_transfer_buffer_size = 256 * 1024
+
+// sftpSender executes the files_for_send() plan over an SFTP connection,
+// used when Options.Protocol == "sftp" to talk to remotes that don't speak
+// kitty's own file transfer protocol.
+type sftpSender struct {
+	client *sftp.Client
+	ssh    *ssh.Client
+	// by_id maps a File.file_id to the remote_path it was sent to, used to
+	// resolve the fid:/fid_abs: forms of symbolic_link_target (see send.go's
+	// symlink-rewriting in files_for_send) to an actual remote path.
+	by_id map[string]string
+}
+
+// dial_sftp opens an SSH connection to host (user@host[:port], same syntax
+// ssh itself accepts) reusing the user's ssh-agent for authentication, and
+// wraps it in an SFTP client.
+func dial_sftp(host string) (*sftpSender, error) {
+	user := ""
+	addr := host
+	if idx := strings.IndexByte(host, '@'); idx >= 0 {
+		user = host[:idx]
+		addr = host[idx+1:]
+	}
+	if !strings.Contains(addr, ":") {
+		addr += ":22"
+	}
+	if user == "" {
+		if u := os.Getenv("USER"); u != "" {
+			user = u
+		}
+	}
+	auth, err := agent_auth_method()
+	if err != nil {
+		return nil, err
+	}
+	host_key_callback, err := known_hosts_callback()
+	if err != nil {
+		return nil, err
+	}
+	config := &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: host_key_callback,
+		Timeout:         30 * time.Second,
+	}
+	conn, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to %s over ssh with error: %w", addr, err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Failed to start an SFTP session on %s with error: %w", addr, err)
+	}
+	return &sftpSender{client: client, ssh: conn}, nil
+}
+
+// known_hosts_callback builds a HostKeyCallback backed by the user's
+// ~/.ssh/known_hosts, the same file plain ssh(1)/scp(1) consult, so an SFTP
+// transfer fails closed against an unrecognized or changed host key instead
+// of accepting anything.
+func known_hosts_callback() (ssh.HostKeyCallback, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to locate the home directory to read known_hosts with error: %w", err)
+	}
+	path := filepath.Join(home, ".ssh", "known_hosts")
+	cb, err := knownhosts.New(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s with error: %w (connect once with ssh/scp to populate it)", path, err)
+	}
+	return cb, nil
+}
+
+// agent_auth_method connects to the running ssh-agent (via SSH_AUTH_SOCK,
+// the same mechanism plain ssh(1) uses) so the user's existing keys work
+// without us having to know about key files or passphrases.
+func agent_auth_method() (ssh.AuthMethod, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, fmt.Errorf("SSH_AUTH_SOCK is not set, cannot authenticate without ssh-agent")
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to ssh-agent with error: %w", err)
+	}
+	ag := agent.NewClient(conn)
+	return ssh.PublicKeysCallback(ag.Signers), nil
+}
+
+func (self *sftpSender) Close() error {
+	cerr := self.client.Close()
+	serr := self.ssh.Close()
+	if cerr != nil {
+		return cerr
+	}
+	return serr
+}
+
+// send_one transmits a single File over the already-open SFTP connection,
+// creating directories and symlinks, hard-linking duplicate files using the
+// hardlink@openssh.com extension, and preserving mode and mtime. Progress
+// is reported into f.transmitted_bytes/f.reported_progress exactly like the
+// native protocol's File.state machine does, so the existing progress bar
+// code works unmodified.
+func (self *sftpSender) send_one(f *File, report_progress func(*File)) error {
+	f.transmit_started_at = time.Now()
+	defer func() { f.transmit_ended_at = time.Now() }()
+
+	switch f.file_type {
+	case DIRECTORY_FILE:
+		if err := self.client.MkdirAll(f.remote_path); err != nil {
+			return fmt.Errorf("Failed to create remote directory %s with error: %w", f.remote_path, err)
+		}
+	case SYMLINK_FILE:
+		target, err := self.resolve_symlink_target(f)
+		if err != nil {
+			return err
+		}
+		if err := self.client.Symlink(target, f.remote_path); err != nil {
+			return fmt.Errorf("Failed to create remote symlink %s with error: %w", f.remote_path, err)
+		}
+	case LINK_FILE:
+		if err := self.hard_link(f); err != nil {
+			return err
+		}
+	case REGULAR_FILE:
+		if err := self.send_regular_file(f, report_progress); err != nil {
+			return err
+		}
+	}
+	if f.file_type != SYMLINK_FILE && f.file_type != LINK_FILE {
+		if err := self.client.Chmod(f.remote_path, f.permissions); err != nil {
+			return fmt.Errorf("Failed to chmod %s with error: %w", f.remote_path, err)
+		}
+		if err := self.client.Chtimes(f.remote_path, f.mtime, f.mtime); err != nil {
+			return fmt.Errorf("Failed to set mtime on %s with error: %w", f.remote_path, err)
+		}
+	}
+	f.state = FINISHED
+	f.done_at = time.Now()
+	return nil
+}
+
+// resolve_symlink_target turns f.symbolic_link_target (as produced by
+// files_for_send()'s symlink-rewriting) into the path to actually pass to
+// Symlink(): "path:" targets outside the transfer are used verbatim, while
+// "fid:"/"fid_abs:" targets name another transferred file by its file_id and
+// must be resolved via self.by_id to that file's real remote_path ("fid:"
+// is then made relative to the symlink's own directory, to reproduce the
+// original relative link; "fid_abs:" is used as an absolute path directly).
+func (self *sftpSender) resolve_symlink_target(f *File) (string, error) {
+	switch {
+	case strings.HasPrefix(f.symbolic_link_target, "path:"):
+		return strings.TrimPrefix(f.symbolic_link_target, "path:"), nil
+	case strings.HasPrefix(f.symbolic_link_target, "fid_abs:"):
+		id := strings.TrimPrefix(f.symbolic_link_target, "fid_abs:")
+		remote_path, ok := self.by_id[id]
+		if !ok {
+			return "", fmt.Errorf("symlink %s refers to unknown file id %s", f.remote_path, id)
+		}
+		return remote_path, nil
+	case strings.HasPrefix(f.symbolic_link_target, "fid:"):
+		id := strings.TrimPrefix(f.symbolic_link_target, "fid:")
+		remote_path, ok := self.by_id[id]
+		if !ok {
+			return "", fmt.Errorf("symlink %s refers to unknown file id %s", f.remote_path, id)
+		}
+		rel, err := filepath.Rel(filepath.Dir(f.remote_path), remote_path)
+		if err != nil {
+			return remote_path, nil
+		}
+		return rel, nil
+	default:
+		return f.symbolic_link_target, nil
+	}
+}
+
+// hard_link uses the hardlink@openssh.com SFTP extension to recreate a
+// hard link on the remote side between f and the first file in its hard
+// link group (identified by file_id via self.by_id), which must already
+// have been sent (files_for_send() always orders the first member of a
+// group before the rest).
+func (self *sftpSender) hard_link(f *File) error {
+	target, ok := self.by_id[f.hard_link_target]
+	if !ok {
+		return fmt.Errorf("hard link %s refers to unknown file id %s", f.remote_path, f.hard_link_target)
+	}
+	if err := self.client.Link(target, f.remote_path); err != nil {
+		return fmt.Errorf("Failed to create remote hard link %s with error: %w", f.remote_path, err)
+	}
+	return nil
+}
+
+// send_regular_file streams f's contents to the remote side, resuming from
+// f.remote_initial_size if the destination already exists, is non-empty and
+// is no longer than the local file (f.remote_initial_size is set by stat_remote_paths()
+// before transmission begins, -1 meaning the remote file does not exist).
+func (self *sftpSender) send_regular_file(f *File, report_progress func(*File)) error {
+	local, err := os.Open(f.expanded_local_path)
+	if err != nil {
+		return fmt.Errorf("Failed to open local file %s with error: %w", f.local_path, err)
+	}
+	defer local.Close()
+
+	flags := os.O_WRONLY | os.O_CREATE
+	var start int64
+	if f.remote_initial_size > 0 && f.remote_initial_size <= f.file_size {
+		start = f.remote_initial_size
+	} else {
+		flags |= os.O_TRUNC
+	}
+	remote, err := self.client.OpenFile(f.remote_path, flags)
+	if err != nil {
+		return fmt.Errorf("Failed to open remote file %s with error: %w", f.remote_path, err)
+	}
+	defer remote.Close()
+
+	if start > 0 {
+		if _, err = local.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err = remote.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		f.transmitted_bytes = start
+	}
+
+	f.state = TRANSMITTING
+	buf := make([]byte, sftp_transfer_buffer_size)
+	for {
+		n, rerr := local.Read(buf)
+		if n > 0 {
+			if _, werr := remote.Write(buf[:n]); werr != nil {
+				return fmt.Errorf("Failed to write to remote file %s with error: %w", f.remote_path, werr)
+			}
+			f.transmitted_bytes += int64(n)
+			if report_progress != nil {
+				report_progress(f)
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return fmt.Errorf("Failed to read local file %s with error: %w", f.local_path, rerr)
+		}
+	}
+	return nil
+}
+
+// stat_remote_paths fills in remote_initial_size for every regular file in
+// files by stat-ing its remote_path, so send_regular_file() knows whether
+// (and where) it can resume an interrupted transfer.
+func (self *sftpSender) stat_remote_paths(files []*File) {
+	for _, f := range files {
+		if f.file_type != REGULAR_FILE {
+			continue
+		}
+		info, err := self.client.Stat(f.remote_path)
+		if err != nil {
+			f.remote_initial_size = -1
+			continue
+		}
+		f.remote_initial_size = info.Size()
+	}
+}
+
+// send_via_sftp is the Protocol == "sftp" entry point, used instead of the
+// kitty-escape-code transmission path in send_main().
+func send_via_sftp(opts *Options, host string, files []*File, report_progress func(*File)) error {
+	conn, err := dial_sftp(host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.stat_remote_paths(files)
+	conn.by_id = make(map[string]string, len(files))
+	for _, f := range files {
+		conn.by_id[f.file_id] = f.remote_path
+	}
+	for _, f := range files {
+		if err := conn.send_one(f, report_progress); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+// License: GPLv3 Copyright: 2022, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+)
+
+var _ = fmt.Print
+
+const png_signature = "\x89PNG\r\n\x1a\n"
+
+type png_chunk struct {
+	typ  string
+	data []byte
+}
+
+func read_png_chunks(data []byte) (chunks []png_chunk, err error) {
+	if len(data) < len(png_signature) || string(data[:len(png_signature)]) != png_signature {
+		return nil, fmt.Errorf("not a PNG file")
+	}
+	pos := len(png_signature)
+	for pos+8 <= len(data) {
+		length := binary.BigEndian.Uint32(data[pos:])
+		typ := string(data[pos+4 : pos+8])
+		start := pos + 8
+		end := start + int(length)
+		if end+4 > len(data) {
+			return nil, fmt.Errorf("truncated PNG chunk: %s", typ)
+		}
+		chunks = append(chunks, png_chunk{typ: typ, data: data[start:end]})
+		pos = end + 4 // skip the trailing CRC
+		if typ == "IEND" {
+			break
+		}
+	}
+	return
+}
+
+// apng_frame_control mirrors the fields of an fcTL chunk, see the APNG spec
+// at https://wiki.mozilla.org/APNG_Specification
+type apng_frame_control struct {
+	width, height        uint32
+	x_offset, y_offset   uint32
+	delay_num, delay_den uint16
+	dispose_op, blend_op byte
+}
+
+const (
+	apng_dispose_none       = 0
+	apng_dispose_background = 1
+	apng_dispose_previous   = 2
+
+	apng_blend_source = 0
+	apng_blend_over   = 1
+)
+
+func parse_fctl(data []byte) (fc apng_frame_control, err error) {
+	if len(data) < 26 {
+		return fc, fmt.Errorf("fcTL chunk too short")
+	}
+	fc.width = binary.BigEndian.Uint32(data[4:])
+	fc.height = binary.BigEndian.Uint32(data[8:])
+	fc.x_offset = binary.BigEndian.Uint32(data[12:])
+	fc.y_offset = binary.BigEndian.Uint32(data[16:])
+	fc.delay_num = binary.BigEndian.Uint16(data[20:])
+	fc.delay_den = binary.BigEndian.Uint16(data[22:])
+	fc.dispose_op = data[24]
+	fc.blend_op = data[25]
+	return fc, nil
+}
+
+func write_chunk(w *bytes.Buffer, typ string, data []byte) {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(data)))
+	w.Write(length[:])
+	w.WriteString(typ)
+	w.Write(data)
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(typ))
+	crc.Write(data)
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc.Sum32())
+	w.Write(sum[:])
+}
+
+// build_frame_png assembles a standalone PNG for a single animation frame,
+// reusing the original file's IHDR (with the frame's own width/height) and
+// any ancillary chunks (PLTE/tRNS/...) the frame's pixel data depends on.
+func build_frame_png(ihdr []byte, ancillary []png_chunk, fc apng_frame_control, frame_data []byte) []byte {
+	out := bytes.Buffer{}
+	out.WriteString(png_signature)
+	frame_ihdr := make([]byte, len(ihdr))
+	copy(frame_ihdr, ihdr)
+	binary.BigEndian.PutUint32(frame_ihdr[0:], fc.width)
+	binary.BigEndian.PutUint32(frame_ihdr[4:], fc.height)
+	write_chunk(&out, "IHDR", frame_ihdr)
+	for _, c := range ancillary {
+		write_chunk(&out, c.typ, c.data)
+	}
+	write_chunk(&out, "IDAT", frame_data)
+	write_chunk(&out, "IEND", nil)
+	return out.Bytes()
+}
+
+// decode_apng decodes an Animated PNG into one image_frame per fcTL/fdAT (or
+// fcTL/IDAT) pair, compositing each frame onto a canvas the size of the full
+// image according to its dispose_op/blend_op, per the APNG spec. It returns
+// an error (and decode_frames falls back to treating the file as a single
+// static frame) for any file that is not a valid APNG, including plain PNGs
+// with no acTL chunk.
+func decode_apng(r io.Reader) (frames []image_frame, err error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	chunks, err := read_png_chunks(data)
+	if err != nil {
+		return nil, err
+	}
+	var ihdr []byte
+	var ancillary []png_chunk
+	var has_actl bool
+	type raw_frame struct {
+		fc   apng_frame_control
+		data []byte
+	}
+	var raw_frames []raw_frame
+	var cur *raw_frame
+	seen_fctl := false
+
+	for _, c := range chunks {
+		switch c.typ {
+		case "IHDR":
+			ihdr = c.data
+		case "acTL":
+			has_actl = true
+		case "fcTL":
+			if cur != nil {
+				raw_frames = append(raw_frames, *cur)
+			}
+			fc, ferr := parse_fctl(c.data)
+			if ferr != nil {
+				return nil, ferr
+			}
+			cur = &raw_frame{fc: fc}
+			seen_fctl = true
+		case "IDAT":
+			if !seen_fctl {
+				// a default image preceding the first fcTL: only shown by
+				// non-APNG-aware decoders, not part of the animation
+				continue
+			}
+			cur.data = append(cur.data, c.data...)
+		case "fdAT":
+			if cur == nil || len(c.data) < 4 {
+				continue
+			}
+			cur.data = append(cur.data, c.data[4:]...) // strip the sequence_number prefix
+		case "IEND":
+		default:
+			if !seen_fctl {
+				ancillary = append(ancillary, c)
+			}
+		}
+	}
+	if cur != nil {
+		raw_frames = append(raw_frames, *cur)
+	}
+	if !has_actl || len(ihdr) < 8 || len(raw_frames) == 0 {
+		return nil, fmt.Errorf("not an animated PNG")
+	}
+
+	full_w := int(binary.BigEndian.Uint32(ihdr[0:]))
+	full_h := int(binary.BigEndian.Uint32(ihdr[4:]))
+	canvas := image.NewNRGBA(image.Rect(0, 0, full_w, full_h))
+	var saved *image.NRGBA
+	var prev_dispose byte = apng_dispose_none
+	var prev_rect image.Rectangle
+
+	frames = make([]image_frame, 0, len(raw_frames))
+	for _, rf := range raw_frames {
+		switch prev_dispose {
+		case apng_dispose_background:
+			draw.Draw(canvas, prev_rect, image.Transparent, image.Point{}, draw.Src)
+		case apng_dispose_previous:
+			if saved != nil {
+				draw.Draw(canvas, canvas.Bounds(), saved, canvas.Bounds().Min, draw.Src)
+			}
+		}
+
+		rect := image.Rect(int(rf.fc.x_offset), int(rf.fc.y_offset),
+			int(rf.fc.x_offset+rf.fc.width), int(rf.fc.y_offset+rf.fc.height))
+		if rf.fc.dispose_op == apng_dispose_previous {
+			saved = image.NewNRGBA(canvas.Bounds())
+			draw.Draw(saved, canvas.Bounds(), canvas, canvas.Bounds().Min, draw.Src)
+		}
+
+		sub_png := build_frame_png(ihdr, ancillary, rf.fc, rf.data)
+		sub_img, derr := png.Decode(bytes.NewReader(sub_png))
+		if derr != nil {
+			return nil, derr
+		}
+		op := draw.Over
+		if rf.fc.blend_op == apng_blend_source {
+			op = draw.Src
+		}
+		draw.Draw(canvas, rect, sub_img, sub_img.Bounds().Min, op)
+
+		out := image.NewNRGBA(canvas.Bounds())
+		draw.Draw(out, out.Bounds(), canvas, canvas.Bounds().Min, draw.Src)
+		delay := 10 // default to a tenth of a second, as most decoders do when delay_num/den is 0
+		if rf.fc.delay_num != 0 {
+			if rf.fc.delay_den != 0 {
+				delay = int(rf.fc.delay_num) * 100 / int(rf.fc.delay_den)
+			} else {
+				delay = int(rf.fc.delay_num)
+			}
+		}
+		frames = append(frames, image_frame{img: out, delay: delay})
+
+		prev_dispose, prev_rect = rf.fc.dispose_op, rect
+	}
+	return frames, nil
+}
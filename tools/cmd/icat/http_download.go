@@ -0,0 +1,278 @@
+// License: GPLv3 Copyright: 2022, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// spool_to_memory_limit is the largest response body we will buffer in RAM
+// instead of spooling to a temporary file; above this (or when
+// Content-Length is absent) we write to disk as the bytes arrive so a
+// multi-gigabyte image does not have to be fully resident in memory before
+// decoding can even start. A spooled body that turns out to be no larger
+// than this is read back into memory.
+const spool_to_memory_limit = 4 * 1024 * 1024
+
+// download_timeout bounds how long we wait for the whole response; it is
+// generous because some image hosts are slow, but it must not be infinite
+// so a single hung URL can't wedge a `icat a.png b.png url` invocation
+// forever.
+const download_timeout = 60 * time.Second
+
+// spooled_file wraps a temporary file created to hold a downloaded response
+// body, deleting it from disk once closed since by that point its contents
+// have already been decoded into memory by the image package.
+type spooled_file struct {
+	*os.File
+}
+
+func (self *spooled_file) Close() error {
+	path := self.File.Name()
+	err := self.File.Close()
+	os.Remove(path)
+	return err
+}
+
+// cache_dir_for_icat returns $XDG_CACHE_HOME/kitty/icat, creating it if
+// necessary.
+func cache_dir_for_icat() (string, error) {
+	base := os.Getenv("XDG_CACHE_HOME")
+	if base == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		base = filepath.Join(home, ".cache")
+	}
+	dir := filepath.Join(base, "kitty", "icat")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// cache_key_for_url returns the file name stem (a hex SHA-256 of the URL)
+// that the downloaded body (<key>.body) and its metadata (<key>.json: etag,
+// content-type) are cached under in the cache directory.
+func cache_key_for_url(url string) string {
+	h := sha256.Sum256([]byte(url))
+	return hex.EncodeToString(h[:])
+}
+
+type cached_meta struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	ContentType  string `json:"content_type,omitempty"`
+}
+
+func load_cached_meta(dir, key string) (*cached_meta, bool) {
+	data, err := os.ReadFile(filepath.Join(dir, key+".json"))
+	if err != nil {
+		return nil, false
+	}
+	var m cached_meta
+	if json.Unmarshal(data, &m) != nil {
+		return nil, false
+	}
+	if _, err := os.Stat(filepath.Join(dir, key+".body")); err != nil {
+		return nil, false
+	}
+	return &m, true
+}
+
+func save_cached_meta(dir, key string, m *cached_meta) {
+	data, err := json.Marshal(m)
+	if err == nil {
+		os.WriteFile(filepath.Join(dir, key+".json"), data, 0o644)
+	}
+}
+
+// unsupported_by_content_type reports whether ct (a Content-Type header
+// value) or the extension on url is one we know we cannot decode, so we can
+// bail out before spending time/bandwidth downloading the body.
+func unsupported_by_content_type(content_type, url string) bool {
+	ct, _, _ := mime.ParseMediaType(content_type)
+	if ct != "" {
+		if !strings.HasPrefix(ct, "image/") {
+			return true
+		}
+		return false
+	}
+	ext := strings.ToLower(filepath.Ext(strings.SplitN(url, "?", 2)[0]))
+	switch ext {
+	case "", ".png", ".jpg", ".jpeg", ".gif", ".webp", ".bmp", ".tiff", ".tif":
+		return false
+	default:
+		return !strings.HasPrefix(utils.GuessMimeType(url), "image/")
+	}
+}
+
+// download_context returns a context that is cancelled either when
+// download_timeout elapses or when keep_going is cleared (e.g. by a Ctrl-C
+// handler), whichever comes first.
+func download_context() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), download_timeout)
+	stop := make(chan struct{})
+	go func() {
+		t := time.NewTicker(100 * time.Millisecond)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				if !keep_going.Load() {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	return ctx, func() { close(stop); cancel() }
+}
+
+// fetch_http_url downloads url, honoring an on-disk ETag/Last-Modified
+// cache in $XDG_CACHE_HOME/kitty/icat so re-running icat on the same URL
+// does not re-fetch an unchanged resource, and spooling large bodies to a
+// temporary file instead of buffering them fully in memory.
+func fetch_http_url(url string) (opened_input, error) {
+	ctx, cancel := download_context()
+	defer cancel()
+
+	cache_dir, cache_err := cache_dir_for_icat()
+	key := cache_key_for_url(url)
+	var cached *cached_meta
+	if cache_err == nil {
+		cached, _ = load_cached_meta(cache_dir, key)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if cached != nil {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		f, err := os.Open(filepath.Join(cache_dir, key+".body"))
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status: %v", resp.Status)
+	}
+
+	content_type := resp.Header.Get("Content-Type")
+	if unsupported_by_content_type(content_type, url) {
+		return nil, fmt.Errorf("unsupported content type: %s", content_type)
+	}
+
+	body_path := ""
+	if cache_err == nil {
+		body_path = filepath.Join(cache_dir, key+".body")
+	}
+	f, err := spool_response_body(resp, body_path)
+	if err != nil {
+		return nil, err
+	}
+	if cache_err == nil {
+		etag := resp.Header.Get("ETag")
+		last_mod := resp.Header.Get("Last-Modified")
+		if etag != "" || last_mod != "" {
+			save_cached_meta(cache_dir, key, &cached_meta{ETag: etag, LastModified: last_mod, ContentType: content_type})
+		}
+	}
+	return f, nil
+}
+
+// spool_response_body reads resp.Body fully, writing it to a temporary file
+// (and, if cache_path is non-empty, simultaneously to the on-disk cache)
+// when Content-Length is large or unknown; small known-length bodies are
+// buffered in memory instead to avoid the overhead of a temp file for a
+// typical small icon/photo.
+func spool_response_body(resp *http.Response, cache_path string) (opened_input, error) {
+	if resp.ContentLength > 0 && resp.ContentLength <= spool_to_memory_limit {
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		if cache_path != "" {
+			os.WriteFile(cache_path, data, 0o644)
+		}
+		return &BytesBuf{data: data}, nil
+	}
+
+	tmp, err := os.CreateTemp("", "kitty-icat-*")
+	if err != nil {
+		return nil, err
+	}
+	var dest io.Writer = tmp
+	var cache_file *os.File
+	if cache_path != "" {
+		if cache_file, err = os.Create(cache_path); err == nil {
+			dest = io.MultiWriter(tmp, cache_file)
+		}
+	}
+	n, err := io.Copy(dest, resp.Body)
+	if cache_file != nil {
+		cache_file.Close()
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		if cache_path != "" {
+			os.Remove(cache_path)
+		}
+		return nil, err
+	}
+	if n <= spool_to_memory_limit {
+		// the body turned out small despite an unknown/absent
+		// Content-Length: no point keeping a temp file around for
+		// something this small, just read it back into memory
+		data, read_err := os.ReadFile(tmp.Name())
+		tmp.Close()
+		os.Remove(tmp.Name())
+		if read_err == nil {
+			return &BytesBuf{data: data}, nil
+		}
+		return nil, read_err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return &spooled_file{File: tmp}, nil
+}
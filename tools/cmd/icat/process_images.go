@@ -4,15 +4,28 @@ package icat
 
 import (
 	"bytes"
+	"encoding/base64"
 	"fmt"
 	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	_ "image/jpeg"
+	"image/png"
 	"io"
 	"io/fs"
-	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+	"golang.org/x/term"
 
 	"kitty/tools/tty"
 	"kitty/tools/utils"
@@ -20,6 +33,387 @@ import (
 
 var _ = fmt.Print
 
+func init() {
+	image.RegisterFormat("webp", "RIFF????WEBP", webp.Decode, webp.DecodeConfig)
+}
+
+// gr_chunk_size is the number of base64 bytes kitty will accept in a single
+// graphics command payload chunk, per the kitty graphics protocol spec.
+const gr_chunk_size = 4096
+
+// a single decoded frame ready for transmission, along with how long it
+// should be displayed for when part of an animation
+type image_frame struct {
+	img   image.Image
+	delay int // hundredths of a second, 0 for a static image
+}
+
+func decode_frames(f opened_input, format string) (frames []image_frame, err error) {
+	f.Seek(0, io.SeekStart)
+	switch format {
+	case "gif":
+		g, derr := gif.DecodeAll(f)
+		if derr != nil {
+			return nil, derr
+		}
+		frames = make([]image_frame, len(g.Image))
+		for i, pm := range g.Image {
+			frames[i] = image_frame{img: pm, delay: g.Delay[i]}
+		}
+	case "png":
+		if apng_frames, aerr := decode_apng(f); aerr == nil {
+			return apng_frames, nil
+		}
+		f.Seek(0, io.SeekStart)
+		img, _, derr := image.Decode(f)
+		if derr != nil {
+			return nil, derr
+		}
+		frames = []image_frame{{img: img}}
+	default:
+		img, _, derr := image.Decode(f)
+		if derr != nil {
+			return nil, derr
+		}
+		frames = []image_frame{{img: img}}
+	}
+	return
+}
+
+// fit_image computes the destination size in pixels for an image of size
+// (w, h) so that it fits the terminal cell grid, honoring opts.ScaleUp.
+// opts.Place/opts.Align are applied afterwards, by resolve_placement.
+func fit_image(w, h int, cell_width, cell_height, num_cols, num_rows int) (dw, dh int) {
+	avail_w := cell_width * num_cols
+	avail_h := cell_height * num_rows
+	if avail_w <= 0 || avail_h <= 0 {
+		return w, h
+	}
+	if w <= avail_w && h <= avail_h && !opts.ScaleUp {
+		return w, h
+	}
+	scale := utils.Min(float64(avail_w)/float64(w), float64(avail_h)/float64(h))
+	dw = int(float64(w) * scale)
+	dh = int(float64(h) * scale)
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+	return
+}
+
+// parse_place parses the --place option's "<cols>x<rows>@<left>x<top>"
+// syntax (either half may be omitted, e.g. "@5x2" to just reposition without
+// overriding the fitted size). ok is false when place is empty, meaning the
+// caller should fall back to opts.Align instead.
+func parse_place(place string) (cols, rows, left, top int, ok bool) {
+	if place == "" {
+		return 0, 0, 0, 0, false
+	}
+	dims, pos := place, ""
+	if idx := strings.IndexByte(place, '@'); idx >= 0 {
+		dims, pos = place[:idx], place[idx+1:]
+	}
+	if dims != "" {
+		if parts := strings.SplitN(dims, "x", 2); len(parts) == 2 {
+			cols, _ = strconv.Atoi(parts[0])
+			rows, _ = strconv.Atoi(parts[1])
+		}
+	}
+	if pos != "" {
+		if parts := strings.SplitN(pos, "x", 2); len(parts) == 2 {
+			left, _ = strconv.Atoi(parts[0])
+			top, _ = strconv.Atoi(parts[1])
+		}
+	}
+	return cols, rows, left, top, true
+}
+
+// apply_place_grid overrides the terminal cell grid an image is fitted into
+// when opts.Place gives an explicit <cols>x<rows> size, so fit_image sees
+// the requested grid instead of the whole terminal. Must be called before
+// fit_image; resolve_placement handles the rest of --place/--align once the
+// image has actually been fitted/resized to that grid.
+func apply_place_grid(num_cols, num_rows int) (int, int) {
+	if cols, rows, _, _, ok := parse_place(opts.Place); ok {
+		if cols > 0 {
+			num_cols = cols
+		}
+		if rows > 0 {
+			num_rows = rows
+		}
+	}
+	return num_cols, num_rows
+}
+
+// resolve_placement honors opts.Place/opts.Align once an image of width dw
+// has been fitted to num_cols: opts.Place repositions the cursor, otherwise
+// opts.Align pads with spaces to left/center/right align the image within
+// num_cols.
+func resolve_placement(num_cols, dw, cell_width int) {
+	if _, _, left, top, ok := parse_place(opts.Place); ok {
+		fmt.Fprintf(os.Stdout, "\x1b[%d;%dH", top+1, left+1)
+		return
+	}
+	dw_cells := dw / cell_width
+	if dw_cells > num_cols {
+		dw_cells = num_cols
+	}
+	offset := 0
+	switch opts.Align {
+	case "center":
+		offset = (num_cols - dw_cells) / 2
+	case "right":
+		offset = num_cols - dw_cells
+	}
+	if offset > 0 {
+		fmt.Fprint(os.Stdout, strings.Repeat(" ", offset))
+	}
+}
+
+func resize_frame(img image.Image, dw, dh int) *image.NRGBA {
+	b := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	if dw == b.Dx() && dh == b.Dy() {
+		draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+		return dst
+	}
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, b, xdraw.Over, nil)
+	return dst
+}
+
+// next_image_id hands out the id shared by every frame of one animation, so
+// that the a=f/a=a controls below can all refer back to the same image.
+var next_image_id int32
+
+func new_image_id() int { return int(atomic.AddInt32(&next_image_id, 1)) }
+
+// transmit_image sends a single frame using the kitty graphics protocol.
+// When direct is true the raw RGBA pixel data is sent (f=32), otherwise the
+// frame is PNG encoded first (f=100) which is smaller over the wire but
+// costs CPU time to encode. frame_index 0 creates and displays the image
+// (a=T); for an animation, every later frame is transmitted with a=f against
+// the shared image_id and immediately followed by an a=a control that tells
+// the terminal to advance the animation to it after delay_ms, rather than
+// relying on the client sleeping between transmissions.
+func transmit_image(img *image.NRGBA, direct bool, frame_index int, image_id int, delay_ms int) error {
+	var payload []byte
+	controls := map[string]string{"q": "2"}
+	if frame_index == 0 {
+		controls["a"] = "T"
+	} else {
+		controls["a"] = "f"
+	}
+	if image_id != 0 {
+		controls["i"] = strconv.Itoa(image_id)
+	}
+	if direct {
+		controls["f"] = "32"
+		controls["s"] = strconv.Itoa(img.Bounds().Dx())
+		controls["v"] = strconv.Itoa(img.Bounds().Dy())
+		payload = img.Pix
+	} else {
+		buf := bytes.Buffer{}
+		if err := png_encode(&buf, img); err != nil {
+			return err
+		}
+		controls["f"] = "100"
+		payload = buf.Bytes()
+	}
+	if opts.ZIndex != 0 {
+		controls["z"] = strconv.Itoa(opts.ZIndex)
+	}
+	if err := send_graphics_chunks(controls, payload); err != nil {
+		return err
+	}
+	if frame_index > 0 {
+		frame_number := strconv.Itoa(frame_index + 1) // frame numbers are 1-based
+		animate := map[string]string{"a": "a", "i": strconv.Itoa(image_id), "r": frame_number}
+		if delay_ms > 0 {
+			animate["g"] = strconv.Itoa(delay_ms) // gap before the terminal advances to this frame
+		}
+		return send_graphics_chunks(animate, nil)
+	}
+	return nil
+}
+
+func png_encode(w io.Writer, img image.Image) error {
+	return png.Encode(w, img)
+}
+
+type graphics_support int
+
+const (
+	gs_unknown graphics_support = iota
+	gs_kitty
+	gs_sixel
+	gs_unicode_placeholder
+)
+
+var detected_graphics_support graphics_support
+var detect_support_once sync.Once
+
+// detect_support probes the terminal we are running inside of for kitty
+// graphics protocol support, falling back to sixel and finally to plain
+// unicode block placeholders when neither is available. The result is
+// cached for the lifetime of the process.
+func detect_support() graphics_support {
+	detect_support_once.Do(func() {
+		detected_graphics_support = probe_terminal_for_graphics_support()
+	})
+	return detected_graphics_support
+}
+
+func probe_terminal_for_graphics_support() graphics_support {
+	fd := int(os.Stdin.Fd())
+	if !tty.IsTerminal(uintptr(fd)) || !tty.IsTerminal(os.Stdout.Fd()) {
+		return gs_unicode_placeholder
+	}
+	old, err := term.MakeRaw(fd)
+	if err != nil {
+		return gs_unicode_placeholder
+	}
+	defer term.Restore(fd, old)
+
+	// a=q asks the terminal to report whether it supports the graphics
+	// protocol without actually displaying anything (i=31 is a throwaway id)
+	fmt.Fprint(os.Stdout, "\x1b_Gi=31,s=1,v=1,a=q,t=d,f=24;AAAA\x1b\\")
+	// sixel terminals respond to DA1 with parameter 4 in their attributes
+	fmt.Fprint(os.Stdout, "\x1b[c")
+
+	os.Stdin.SetReadDeadline(time.Now().Add(2 * time.Second))
+	defer os.Stdin.SetReadDeadline(time.Time{})
+	buf := make([]byte, 0, 512)
+	chunk := make([]byte, 256)
+	for {
+		n, err := os.Stdin.Read(chunk)
+		if n > 0 {
+			buf = append(buf, chunk[:n]...)
+		}
+		if err != nil || bytes.Contains(buf, []byte("c")) {
+			break
+		}
+	}
+	reply := string(buf)
+	if strings.Contains(reply, "_Gi=31;OK") {
+		return gs_kitty
+	}
+	if strings.Contains(reply, ";4;") || strings.Contains(reply, ";4c") {
+		return gs_sixel
+	}
+	return gs_unicode_placeholder
+}
+
+// transmit_sixel encodes img as a DEC sixel image using a simple per-pixel
+// palette (no quantization/dithering) and writes it directly to the
+// terminal. It is a fallback for terminals that support sixel graphics but
+// not the kitty graphics protocol.
+func transmit_sixel(img *image.NRGBA) error {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	palette := make(map[[3]byte]int)
+	var colors [][3]byte
+	index_of := func(c color.NRGBA) int {
+		key := [3]byte{c.R, c.G, c.B}
+		if idx, ok := palette[key]; ok {
+			return idx
+		}
+		idx := len(colors)
+		palette[key] = idx
+		colors = append(colors, key)
+		return idx
+	}
+
+	out := bytes.Buffer{}
+	out.WriteString("\x1bPq")
+	for y := 0; y < h; y += 6 {
+		band_height := utils.Min(6, h-y)
+		for x := 0; x < w; x++ {
+			var sixel byte
+			var last_color_idx = -1
+			for dy := 0; dy < band_height; dy++ {
+				c := img.NRGBAAt(b.Min.X+x, b.Min.Y+y+dy)
+				ci := index_of(c)
+				if last_color_idx == -1 {
+					last_color_idx = ci
+				}
+				if ci == last_color_idx {
+					sixel |= 1 << uint(dy)
+				}
+			}
+			if last_color_idx >= 0 {
+				rgb := colors[last_color_idx]
+				out.WriteString(fmt.Sprintf("#%d;2;%d;%d;%d", last_color_idx,
+					int(rgb[0])*100/255, int(rgb[1])*100/255, int(rgb[2])*100/255))
+			}
+			out.WriteByte('?' + sixel)
+		}
+		out.WriteString("-")
+	}
+	out.WriteString("\x1b\\")
+	_, err := os.Stdout.Write(out.Bytes())
+	return err
+}
+
+// render_unicode_placeholder draws a simple coloured grid of unicode block
+// characters as a last resort fallback when the terminal supports neither
+// the kitty graphics protocol nor sixel.
+func render_unicode_placeholder(img image.Image, num_cols, num_rows int) {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	for row := 0; row < num_rows; row++ {
+		for col := 0; col < num_cols; col++ {
+			x := b.Min.X + (col*w)/num_cols
+			y := b.Min.Y + (row*h)/num_rows
+			r, g, bch, _ := img.At(x, y).RGBA()
+			fmt.Printf("\x1b[48;2;%d;%d;%dm ", r>>8, g>>8, bch>>8)
+		}
+		fmt.Print("\x1b[0m\n")
+	}
+}
+
+// send_graphics_chunks emits \x1b_G...\x1b\ escape codes, splitting the
+// base64 encoded payload into gr_chunk_size byte pieces and setting m=1 on
+// all but the last chunk as required by the protocol. A nil/empty payload is
+// valid (e.g. for the a=a animation control, which carries no pixel data)
+// and is sent as a single chunk.
+func send_graphics_chunks(controls map[string]string, payload []byte) error {
+	out := os.Stdout
+	if len(payload) == 0 {
+		parts := make([]string, 0, len(controls))
+		for k, v := range controls {
+			parts = append(parts, k+"="+v)
+		}
+		_, err := fmt.Fprintf(out, "\x1b_G%s;\x1b\\", strings.Join(parts, ","))
+		return err
+	}
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(payload)))
+	base64.StdEncoding.Encode(encoded, payload)
+	for len(encoded) > 0 {
+		chunk := encoded
+		more := 0
+		if len(chunk) > gr_chunk_size {
+			chunk = encoded[:gr_chunk_size]
+			more = 1
+		}
+		encoded = encoded[len(chunk):]
+		parts := make([]string, 0, len(controls)+1)
+		for k, v := range controls {
+			parts = append(parts, k+"="+v)
+		}
+		parts = append(parts, "m="+strconv.Itoa(more))
+		if _, err := fmt.Fprintf(out, "\x1b_G%s;%s\x1b\\", strings.Join(parts, ","), chunk); err != nil {
+			return err
+		}
+		// only the first chunk needs the placement/action controls, the
+		// rest just continue the transmission
+		controls = map[string]string{}
+	}
+	return nil
+}
+
 type BytesBuf struct {
 	data []byte
 	pos  int64
@@ -120,24 +514,12 @@ type opened_input interface {
 func process_arg(arg input_arg) {
 	var f opened_input
 	if arg.is_http_url {
-		resp, err := http.Get(arg.value)
-		if err != nil {
-			report_error(arg.value, "Could not get", err)
-			return
-		}
-		defer resp.Body.Close()
-		if resp.StatusCode != http.StatusOK {
-			report_error(arg.value, "Could not get", fmt.Errorf("bad status: %v", resp.Status))
-			return
-		}
-		dest := bytes.Buffer{}
-		dest.Grow(64 * 1024)
-		_, err = io.Copy(&dest, resp.Body)
+		downloaded, err := fetch_http_url(arg.value)
 		if err != nil {
 			report_error(arg.value, "Could not download", err)
 			return
 		}
-		f = &BytesBuf{data: dest.Bytes()}
+		f = downloaded
 	} else if arg.value == "" {
 		stdin, err := io.ReadAll(os.Stdin)
 		if err != nil {
@@ -154,21 +536,94 @@ func process_arg(arg input_arg) {
 		f = q
 	}
 	defer f.Close()
-	c, format, err := image.DecodeConfig(f)
+	_, format, err := image.DecodeConfig(f)
+	if err != nil {
+		report_error(arg.value, "Not a recognized image format", err)
+		return
+	}
 	f.Seek(0, io.SeekStart)
 
-}
+	frames, err := decode_frames(f, format)
+	if err != nil {
+		report_error(arg.value, "Could not decode", err)
+		return
+	}
+	if len(frames) == 0 {
+		return
+	}
 
-func run_worker() {
-	for {
-		select {
-		case arg := <-files_channel:
+	support := detect_support()
+	num_cols, num_rows, cell_width, cell_height := terminal_cell_geometry()
+	num_cols, num_rows = apply_place_grid(num_cols, num_rows)
+	b := frames[0].img.Bounds()
+	dw, dh := fit_image(b.Dx(), b.Dy(), cell_width, cell_height, num_cols, num_rows)
+	resolve_placement(num_cols, dw, cell_width)
+
+	switch support {
+	case gs_kitty:
+		direct := len(frames) == 1
+		image_id := 0
+		if len(frames) > 1 {
+			image_id = new_image_id()
+		}
+		for i, frame := range frames {
 			if !keep_going.Load() {
 				return
 			}
-			process_arg(arg)
-		default:
+			resized := resize_frame(frame.img, dw, dh)
+			if err := transmit_image(resized, direct, i, image_id, frame.delay*10); err != nil {
+				report_error(arg.value, "Could not transmit", err)
+				return
+			}
+		}
+	case gs_sixel:
+		// sixel output is handled by a dedicated encoder; direct RGBA/PNG
+		// transmission above is specific to the kitty graphics protocol
+		resized := resize_frame(frames[0].img, dw, dh)
+		if err := transmit_sixel(resized); err != nil {
+			report_error(arg.value, "Could not transmit sixel", err)
+		}
+	default:
+		resized := resize_frame(frames[0].img, dw, dh)
+		render_unicode_placeholder(resized, dw/cell_width+1, dh/cell_height+1)
+	}
+}
+
+// terminal_cell_geometry returns the number of text columns/rows in the
+// controlling terminal and the pixel size of a single cell, used to fit
+// images to the available space.
+func terminal_cell_geometry() (num_cols, num_rows, cell_width, cell_height int) {
+	ws, err := tty.GetSize(os.Stdout.Fd())
+	if err != nil || ws.Col == 0 || ws.Row == 0 {
+		return 80, 24, 8, 16
+	}
+	num_cols, num_rows = int(ws.Col), int(ws.Row)
+	cell_width, cell_height = 8, 16
+	if ws.Xpixel > 0 && ws.Ypixel > 0 {
+		cell_width = int(ws.Xpixel) / num_cols
+		cell_height = int(ws.Ypixel) / num_rows
+	}
+	return
+}
+
+func run_worker(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for arg := range files_channel {
+		if !keep_going.Load() {
 			return
 		}
+		process_arg(arg)
+	}
+}
+
+// run_workers drains files_channel using num_workers goroutines running in
+// parallel, returning once all of them have exited (either because the
+// channel was closed or keep_going was cleared by a Ctrl-C handler).
+func run_workers(num_workers int) {
+	var wg sync.WaitGroup
+	wg.Add(num_workers)
+	for i := 0; i < num_workers; i++ {
+		go run_worker(&wg)
 	}
+	wg.Wait()
 }